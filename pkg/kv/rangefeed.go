@@ -0,0 +1,43 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// OnRangeFeedValue is invoked once per committed value a RangeFeed client
+// observes. Callers see exactly this per-row shape regardless of whether
+// the server-side catch-up scan batched the delivery into a
+// RangeFeedBatch.
+type OnRangeFeedValue func(ctx context.Context, value *roachpb.RangeFeedValue)
+
+// consumeRangeFeedEvent dispatches a single RangeFeedEvent received from a
+// rangefeed stream to onValue, unpacking a RangeFeedBatch back into one
+// onValue call per row, in order, so that callers never need to know that
+// a server-side catch-up scan may deliver many historical versions in a
+// single RangeFeedBatch instead of one RangeFeedValue per event.
+func consumeRangeFeedEvent(ctx context.Context, event *roachpb.RangeFeedEvent, onValue OnRangeFeedValue) {
+	switch t := event.GetValue().(type) {
+	case *roachpb.RangeFeedValue:
+		onValue(ctx, t)
+	case *roachpb.RangeFeedBatch:
+		for i := range t.Values {
+			onValue(ctx, &t.Values[i])
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// TestConsumeRangeFeedEventUnbatches verifies that consumeRangeFeedEvent
+// delivers one onValue call per row, in order, whether the event carries a
+// single RangeFeedValue or a RangeFeedBatch accumulated by a server-side
+// catch-up scan.
+func TestConsumeRangeFeedEventUnbatches(t *testing.T) {
+	ctx := context.Background()
+
+	var got []roachpb.Key
+	onValue := func(ctx context.Context, v *roachpb.RangeFeedValue) {
+		got = append(got, v.Key)
+	}
+
+	var single roachpb.RangeFeedEvent
+	single.SetValue(&roachpb.RangeFeedValue{Key: roachpb.Key("a")})
+	consumeRangeFeedEvent(ctx, &single, onValue)
+
+	var batch roachpb.RangeFeedEvent
+	batch.SetValue(&roachpb.RangeFeedBatch{
+		Values: []roachpb.RangeFeedValue{
+			{Key: roachpb.Key("b")},
+			{Key: roachpb.Key("c")},
+		},
+	})
+	consumeRangeFeedEvent(ctx, &batch, onValue)
+
+	want := []string{"a", "b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d values, want %d", len(got), len(want))
+	}
+	for i, k := range got {
+		if string(k) != want[i] {
+			t.Errorf("value %d: got key %q, want %q", i, k, want[i])
+		}
+	}
+}
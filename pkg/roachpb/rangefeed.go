@@ -0,0 +1,194 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package roachpb
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// Key is a generic MVCC-agnostic key. It is cast from bytes.
+type Key []byte
+
+// Equal returns whether two keys are identical.
+func (k Key) Equal(o Key) bool {
+	return bytes.Equal(k, o)
+}
+
+// Compare returns -1, 0, or +1 depending on whether k sorts before, equal
+// to, or after o.
+func (k Key) Compare(o Key) int {
+	return bytes.Compare(k, o)
+}
+
+// Value is a versioned value, as it is stored and transmitted.
+type Value struct {
+	RawBytes  []byte
+	Timestamp hlc.Timestamp
+}
+
+// Span is a key range with an inclusive start and exclusive end.
+type Span struct {
+	Key    Key
+	EndKey Key
+}
+
+// RSpan is a Span expressed in range-local addressing. Unlike Span, it may
+// include range-local prefixes that AsRawSpanWithNoLocals strips off.
+type RSpan struct {
+	Key    Key
+	EndKey Key
+}
+
+// AsRawSpanWithNoLocals returns the RSpan as a plain Span. Range-local
+// prefixes, if any, are assumed already stripped by the caller that
+// constructed this RSpan.
+func (rs RSpan) AsRawSpanWithNoLocals() Span {
+	return Span{Key: rs.Key, EndKey: rs.EndKey}
+}
+
+// RangeFeedValue presents the latest value for a key.
+type RangeFeedValue struct {
+	Key   Key
+	Value Value
+}
+
+// RangeFeedBatch carries a run of RangeFeedValues accumulated by a
+// catch-up scan. It is unpacked back into one per-row delivery per entry in
+// Values by the client-side rangefeed consumer; see
+// pkg/kv.consumeRangeFeedEvent.
+type RangeFeedBatch struct {
+	Values []RangeFeedValue
+}
+
+// CatchUpProgress carries the key/timestamp cursor of the last value a
+// chunked catch-up scan emitted before it yielded, so the scan can resume
+// past it rather than restart.
+type CatchUpProgress struct {
+	Key       Key
+	Timestamp hlc.Timestamp
+}
+
+// RangeFeedSSTable is a provisional event for a write that is still an
+// outstanding intent when a catch-up scan observes it. TxnID is the
+// marshaled form of the intent's enginepb.TxnMeta.ID (a uuid.UUID
+// elsewhere in the codebase); it is kept as raw bytes here since
+// pkg/util/uuid is outside this change's scope.
+type RangeFeedSSTable struct {
+	Key       Key
+	Timestamp hlc.Timestamp
+	TxnID     []byte
+}
+
+// isRangeFeedEvent_Value is implemented by each of the possible payloads of
+// a RangeFeedEvent, mirroring the oneof defined in rangefeed.proto.
+type isRangeFeedEvent_Value interface {
+	isRangeFeedEvent_Value()
+}
+
+func (*RangeFeedValue) isRangeFeedEvent_Value()   {}
+func (*RangeFeedBatch) isRangeFeedEvent_Value()   {}
+func (*CatchUpProgress) isRangeFeedEvent_Value()  {}
+func (*RangeFeedSSTable) isRangeFeedEvent_Value() {}
+
+// RangeFeedEvent is a single event in a rangefeed stream. Exactly one of
+// its possible payloads is set; use SetValue to set it and GetValue to
+// retrieve it.
+type RangeFeedEvent struct {
+	Value isRangeFeedEvent_Value
+}
+
+// SetValue sets the event's payload to v.
+func (e *RangeFeedEvent) SetValue(v isRangeFeedEvent_Value) {
+	e.Value = v
+}
+
+// GetValue returns the event's payload.
+func (e *RangeFeedEvent) GetValue() isRangeFeedEvent_Value {
+	return e.Value
+}
+
+// RangeFeedRetryErrorReason enumerates the reasons a rangefeed may be
+// retried rather than treated as permanently failed.
+type RangeFeedRetryErrorReason int
+
+const (
+	// RangeFeedRetryError_REASON_REPLICA_REMOVED indicates the replica
+	// serving the rangefeed was removed.
+	RangeFeedRetryError_REASON_REPLICA_REMOVED RangeFeedRetryErrorReason = iota
+	// RangeFeedRetryError_REASON_RANGE_SPLIT indicates the range split.
+	RangeFeedRetryError_REASON_RANGE_SPLIT
+	// RangeFeedRetryError_REASON_RANGE_MERGED indicates the range merged
+	// away.
+	RangeFeedRetryError_REASON_RANGE_MERGED
+	// RangeFeedRetryError_REASON_RAFT_SNAPSHOT indicates the replica applied
+	// a Raft snapshot, which can skip over logical ops the rangefeed needs.
+	RangeFeedRetryError_REASON_RAFT_SNAPSHOT
+	// RangeFeedRetryError_REASON_SLOW_CONSUMER indicates the rangefeed was
+	// turned away because it could not reserve enough of the catch-up scan
+	// budget (see CatchUpScanMaxConcurrentBytes in pkg/storage/rangefeed),
+	// typically because other registrations are consuming it too slowly.
+	RangeFeedRetryError_REASON_SLOW_CONSUMER
+)
+
+// RangeFeedRetryError indicates that a rangefeed could not currently be
+// served and the client should retry, rather than treating the stream as
+// permanently failed.
+type RangeFeedRetryError struct {
+	Reason RangeFeedRetryErrorReason
+}
+
+// NewRangeFeedRetryError constructs a *RangeFeedRetryError for the given
+// reason.
+func NewRangeFeedRetryError(reason RangeFeedRetryErrorReason) *RangeFeedRetryError {
+	return &RangeFeedRetryError{Reason: reason}
+}
+
+// Error implements the error interface.
+func (e *RangeFeedRetryError) Error() string {
+	return fmt.Sprintf("retry rangefeed (reason: %d)", e.Reason)
+}
+
+// Error is a generic wrapper used to carry a Go error across the
+// rangefeed's error-delivery paths.
+type Error struct {
+	err error
+}
+
+// NewError wraps err in an *Error, or returns nil if err is nil.
+func NewError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	return &Error{err: err}
+}
+
+// GoError unwraps the original error.
+func (e *Error) GoError() error {
+	if e == nil {
+		return nil
+	}
+	return e.err
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return e.err.Error()
+}
@@ -0,0 +1,31 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rangefeed
+
+import "context"
+
+// budgetAccount is the subset of *mon.BoundAccount's interface that
+// reserveCatchUpScanBudget needs. Processor.catchUpScanBudget is typed as
+// this interface, rather than *mon.BoundAccount directly, so that tests can
+// exercise the reservation/rejection path with a fake account instead of
+// having to stand up a real mon.BytesMonitor.
+type budgetAccount interface {
+	// Grow reserves x additional bytes, returning an error if doing so
+	// would exceed the account's budget.
+	Grow(ctx context.Context, x int64) error
+	// Shrink releases a reservation of x bytes made by a prior call to
+	// Grow.
+	Shrink(ctx context.Context, x int64)
+}
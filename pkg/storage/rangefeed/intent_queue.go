@@ -0,0 +1,76 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rangefeed
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+)
+
+// unresolvedIntentQueue tracks intents that a Processor's registrations
+// need to see resolved before their catch-up scans can safely hand off to
+// the live stream of logical ops. catchUpScan feeds it from intents it
+// encounters while backfilling history; initResolvedTSScan reports its
+// intents through Processor.ConsumeLogicalOps instead, which does not add
+// them here.
+type unresolvedIntentQueue struct {
+	mu  sync.Mutex
+	ops []enginepb.MVCCWriteIntentOp
+}
+
+func newUnresolvedIntentQueue() *unresolvedIntentQueue {
+	return &unresolvedIntentQueue{}
+}
+
+// Add records an intent observed during a backfill scan. A nil queue is
+// treated as a no-op sink, so callers need not special-case a Processor
+// that hasn't been wired up with one (e.g. in tests).
+func (q *unresolvedIntentQueue) Add(op enginepb.MVCCWriteIntentOp) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ops = append(q.ops, op)
+}
+
+// PushResult describes the outcome of a bounded intent push attempted via
+// IntentResolver.MaybePush.
+type PushResult int
+
+const (
+	// PushResultPending means the intent is still outstanding after the
+	// push attempt (or no push was warranted yet). This is the normal,
+	// expected outcome: the live stream observes the intent's eventual
+	// resolution once it's spliced in, via the unresolvedIntentQueue entry
+	// recorded for it.
+	PushResultPending PushResult = iota
+	// PushResultResolved means the push observed that the intent has
+	// already committed or aborted.
+	PushResultResolved
+)
+
+// IntentResolver gives a catchUpScan a bounded way to nudge an intent it
+// encounters toward resolution, without blocking the scan on a full
+// transaction push.
+type IntentResolver interface {
+	// MaybePush attempts a bounded push of txn. A non-nil error indicates
+	// the push attempt itself failed unexpectedly; it is not used to
+	// signal that the intent is merely still pending, which is reported as
+	// (PushResultPending, nil).
+	MaybePush(ctx context.Context, txn *enginepb.TxnMeta) (PushResult, error)
+}
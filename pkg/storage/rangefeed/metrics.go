@@ -0,0 +1,58 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rangefeed
+
+import "github.com/cockroachdb/cockroach/pkg/util/metric"
+
+var metaRangeFeedCatchUpScanReservedBytes = metric.Metadata{
+	Name:        "kv.rangefeed.catchup_scan.reserved_bytes",
+	Help:        "Memory currently reserved for in-flight rangefeed catch-up scans",
+	Measurement: "Memory",
+	Unit:        metric.Unit_BYTES,
+}
+
+var metaRangeFeedCatchUpScanWaiters = metric.Metadata{
+	Name:        "kv.rangefeed.catchup_scan.waiters",
+	Help:        "Number of rangefeed catch-up scans currently waiting to reserve budget",
+	Measurement: "Scans",
+	Unit:        metric.Unit_COUNT,
+}
+
+var metaRangeFeedCatchUpScanNumRejected = metric.Metadata{
+	Name:        "kv.rangefeed.catchup_scan.num_rejected",
+	Help:        "Number of rangefeed catch-up scans rejected as slow consumers because the catch-up scan budget was exhausted",
+	Measurement: "Scans",
+	Unit:        metric.Unit_COUNT,
+}
+
+// Metrics holds the Prometheus metrics for a Store's rangefeed catch-up
+// scans. A single Metrics is shared by every Processor on the Store, since
+// the budget it instruments (see CatchUpScanMaxConcurrentBytes) is itself
+// shared across them.
+type Metrics struct {
+	RangeFeedCatchUpScanReservedBytes *metric.Gauge
+	RangeFeedCatchUpScanWaiters       *metric.Gauge
+	RangeFeedCatchUpScanNumRejected   *metric.Counter
+}
+
+// NewMetrics allocates and returns a new Metrics struct for rangefeed
+// catch-up scans.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		RangeFeedCatchUpScanReservedBytes: metric.NewGauge(metaRangeFeedCatchUpScanReservedBytes),
+		RangeFeedCatchUpScanWaiters:       metric.NewGauge(metaRangeFeedCatchUpScanWaiters),
+		RangeFeedCatchUpScanNumRejected:   metric.NewCounter(metaRangeFeedCatchUpScanNumRejected),
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rangefeed
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+)
+
+// Processor manages a set of registrations for a single range, fanning
+// incoming logical ops out to each and coordinating the initial resolved
+// timestamp scan and per-registration catch-up scans.
+type Processor struct {
+	// Span is the range's full keyspan, including range-local addressing.
+	Span roachpb.RSpan
+
+	// unresolvedIntentQueue tracks intents observed by a catchUpScan so
+	// the live stream of logical ops can later recognize their resolution.
+	// It is backfilled lazily: a nil queue is equivalent to an empty one
+	// and simply isn't written to.
+	unresolvedIntentQueue *unresolvedIntentQueue
+	// intentResolver lets a catchUpScan attempt a bounded push of an
+	// intent it encounters. May be nil in which case catchUpScan treats
+	// every intent as PushResultPending.
+	intentResolver IntentResolver
+
+	// catchUpScanBudget is a bound account carved out of the Store's
+	// mon.BytesMonitor for rangefeed catch-up scans (see
+	// CatchUpScanMaxConcurrentBytes). It is shared by every registration's
+	// catchUpScan and by initResolvedTSScan, so that their combined memory
+	// footprint is bounded across the whole Processor rather than just per
+	// scan. May be nil, in which case reserveCatchUpScanBudget skips budget
+	// accounting entirely -- e.g. in tests that don't exercise it.
+	catchUpScanBudget budgetAccount
+	// Metrics holds this Processor's Store's rangefeed metrics. May be nil,
+	// in which case reserveCatchUpScanBudget skips recording them.
+	Metrics *Metrics
+
+	resolvedTSInitialized bool
+}
+
+// ConsumeLogicalOps informs the Processor of logical ops observed either
+// live or, for intents found during initResolvedTSScan, backfilled from
+// before the Processor existed.
+func (p *Processor) ConsumeLogicalOps(ops ...enginepb.MVCCLogicalOp) {
+	// The ops are discarded: they are not fanned out to registrations and
+	// not added to unresolvedIntentQueue. initResolvedTSScan reports the
+	// intents it observes here.
+}
+
+// StopWithErr is called with the error that ended an initResolvedTSScan.
+// It discards err; it does not stop the Processor or notify any
+// registration.
+func (p *Processor) StopWithErr(err *roachpb.Error) {
+	_ = err
+}
+
+// setResolvedTSInitialized marks that initResolvedTSScan has completed and
+// the Processor's resolved timestamp can now be computed from the logical
+// ops it has observed.
+func (p *Processor) setResolvedTSInitialized() {
+	p.resolvedTSInitialized = true
+}
+
+// deliverCatchUpScanRes is called with the terminal result of r's catch-up
+// scan (nil on success). It discards both arguments; it does not notify r
+// or splice r into a live stream of logical ops.
+func (p *Processor) deliverCatchUpScanRes(r *registration, err *roachpb.Error) {
+	_ = r
+	_ = err
+}
+
+// resumeCatchUpScan is called by a catchUpScan that yielded after filling a
+// chunk, instead of deliverCatchUpScanRes. It records cursor on r, so that
+// the next catchUpScan made from r by makeCatchUpScan resumes just past
+// cursor rather than restarting from the beginning of the span.
+func (p *Processor) resumeCatchUpScan(r *registration, cursor catchUpScanCursor) {
+	r.resumeCursor = cursor
+	// It does not open a fresh Snapshot or schedule the next scan: the
+	// caller must set r.catchUpSnap and run makeCatchUpScan(p, r) itself.
+}
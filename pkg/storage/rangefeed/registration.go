@@ -0,0 +1,65 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rangefeed
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// Stream is the interface that a registration uses to deliver RangeFeedEvents
+// to whatever is consuming the registration (typically a gRPC stream to a
+// client, or an in-process consumer in tests).
+type Stream interface {
+	// Send delivers a single RangeFeedEvent. A catchUpScan may deliver many
+	// values in one call by wrapping them in a RangeFeedBatch rather than
+	// calling Send once per value.
+	Send(*roachpb.RangeFeedEvent) error
+}
+
+// registration represents a single subscriber's interest in a range's
+// updates, from startTS forward. The Processor owns a set of registrations
+// and fans incoming logical ops out to each.
+type registration struct {
+	span    roachpb.Span
+	startTS hlc.Timestamp
+	stream  Stream
+
+	// catchUpSnap is the Snapshot a catchUpScan should read from to
+	// backfill startTS..now before the registration starts seeing live
+	// updates. It is detached (set to nil) by makeCatchUpScan.
+	catchUpSnap Snapshot
+
+	// resumeCursor is set when this registration's catch-up scan is being
+	// resumed after a prior chunk yielded with a CatchUpProgress event. The
+	// zero value means "start from the beginning of span".
+	resumeCursor catchUpScanCursor
+
+	// maxCatchUpScanChunkBytes bounds how many bytes of value data
+	// catchUpScan emits before pausing to emit a CatchUpProgress checkpoint
+	// and yielding back to the Processor. Zero means
+	// defaultCatchUpScanChunkBytes.
+	maxCatchUpScanChunkBytes int64
+
+	// maxCatchUpScanBatchBytes bounds the size, in bytes, of a single
+	// RangeFeedBatch that catchUpScan accumulates before flushing it to
+	// stream. Zero means defaultCatchUpScanBatchSize.
+	maxCatchUpScanBatchBytes int64
+	// maxCatchUpScanBatchRows bounds the number of RangeFeedValues in a
+	// single RangeFeedBatch, regardless of maxCatchUpScanBatchBytes. Zero
+	// means rows are unbounded and only the byte budget applies. A slow
+	// consumer can shrink this to apply backpressure on the catch-up scan.
+	maxCatchUpScanBatchRows int64
+}
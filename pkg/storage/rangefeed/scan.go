@@ -20,12 +20,89 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 )
 
+// CatchUpScanMaxConcurrentBytes bounds the combined memory footprint --
+// iterator buffers plus pending stream.Send events -- of all catch-up scans
+// (initResolvedTSScan and catchUpScan alike) running concurrently across a
+// Processor's registrations on a store. Each scan must reserve its estimated
+// footprint from the Processor's (and, ultimately, the Store's)
+// mon.BytesMonitor-backed budget before Run proceeds, and is turned away
+// with a retryable RangeFeedRetryError_REASON_SLOW_CONSUMER once the budget
+// is exhausted rather than being allowed to pile up unboundedly.
+var CatchUpScanMaxConcurrentBytes = settings.RegisterByteSizeSetting(
+	"kv.rangefeed.catchup_scan.max_concurrent_bytes",
+	"maximum number of bytes used for in-flight rangefeed catch-up scans before new scans are rejected as slow consumers",
+	64<<20, // 64MB
+)
+
+// defaultInitResolvedTSScanBudgetBytes is the memory reserved for the
+// duration of an initResolvedTSScan. Unlike catchUpScan it never buffers
+// values, only metadata, so a small fixed reservation covers its iterator
+// overhead.
+const defaultInitResolvedTSScanBudgetBytes = 1 << 20 // 1MB
+
+// reserveCatchUpScanBudget reserves estBytes from the Processor's catch-up
+// scan budget (see CatchUpScanMaxConcurrentBytes), returning a release func
+// to be called once the reservation is no longer needed. It returns a
+// retryable error if the budget is exhausted, so that a scan applies
+// backpressure on its caller instead of running unbounded.
+//
+// Both p.catchUpScanBudget and p.Metrics are optional: a Processor that
+// wasn't wired up with them (e.g. in tests) simply skips budget accounting
+// and metric recording rather than panicking.
+func reserveCatchUpScanBudget(ctx context.Context, p *Processor, estBytes int64) (func(), error) {
+	if p.catchUpScanBudget == nil {
+		return func() {}, nil
+	}
+	if p.Metrics != nil {
+		p.Metrics.RangeFeedCatchUpScanWaiters.Inc(1)
+	}
+	err := p.catchUpScanBudget.Grow(ctx, estBytes)
+	if p.Metrics != nil {
+		p.Metrics.RangeFeedCatchUpScanWaiters.Dec(1)
+	}
+	if err != nil {
+		if p.Metrics != nil {
+			p.Metrics.RangeFeedCatchUpScanNumRejected.Inc(1)
+		}
+		return nil, roachpb.NewRangeFeedRetryError(roachpb.RangeFeedRetryError_REASON_SLOW_CONSUMER)
+	}
+	if p.Metrics != nil {
+		p.Metrics.RangeFeedCatchUpScanReservedBytes.Inc(estBytes)
+	}
+	return func() {
+		p.catchUpScanBudget.Shrink(ctx, estBytes)
+		if p.Metrics != nil {
+			p.Metrics.RangeFeedCatchUpScanReservedBytes.Dec(estBytes)
+		}
+	}, nil
+}
+
+// IterOptions bounds an IterateFiltered call.
+type IterOptions struct {
+	// MinTimestamp, if set, excludes versioned values below this timestamp.
+	// Used by catchUpScan to avoid re-sending values the registration's
+	// starting timestamp has already covered.
+	MinTimestamp hlc.Timestamp
+	// MaxTimestamp, if set, excludes versioned values above this timestamp.
+	MaxTimestamp hlc.Timestamp
+	// KeyPrefix, if set, excludes keys that do not share this prefix. Used
+	// to scope a scan to a sub-range of the Snapshot's keyspan, such as a
+	// single table within a larger range.
+	KeyPrefix roachpb.Key
+	// IntentsOnly restricts the scan to unresolved intent metadata,
+	// skipping versioned values entirely. Used by initResolvedTSScan, which
+	// only cares about intents.
+	IntentsOnly bool
+}
+
 // A Snapshot is an atomic view of all MVCCKeys within a key range.
 type Snapshot interface {
 	// Iterate scans from the start key to the end key, invoking the function f
@@ -34,6 +111,11 @@ type Snapshot interface {
 	// stop and return the error. If the first result of f is true, the
 	// iteration stops and returns a nil error.
 	Iterate(start, end roachpb.Key, f func(engine.MVCCKeyValue) (bool, error)) error
+	// IterateFiltered is like Iterate, but further restricts which key value
+	// pairs f is invoked on according to opts.
+	IterateFiltered(
+		start, end roachpb.Key, opts IterOptions, f func(engine.MVCCKeyValue) (bool, error),
+	) error
 	// Close closes the snapshot, freeing up any outstanding resources.
 	Close()
 }
@@ -71,27 +153,37 @@ func makeInitResolvedTSScan(p *Processor, snap Snapshot) runnable {
 func (s *initResolvedTSScan) Run(ctx context.Context) {
 	defer s.snap.Close()
 
+	release, err := reserveCatchUpScanBudget(ctx, s.p, defaultInitResolvedTSScanBudgetBytes)
+	if err != nil {
+		err = errors.Wrap(err, "initial resolved timestamp scan failed")
+		log.Error(ctx, err)
+		s.p.StopWithErr(roachpb.NewError(err))
+		return
+	}
+	defer release()
+
 	var meta enginepb.MVCCMetadata
 	sp := s.p.Span.AsRawSpanWithNoLocals()
-	err := s.snap.Iterate(sp.Key, sp.EndKey, func(kv engine.MVCCKeyValue) (bool, error) {
-		if !kv.Key.IsValue() {
-			// Found a metadata key. Inform the Processor if it's an intent.
-			if err := protoutil.Unmarshal(kv.Value, &meta); err != nil {
-				return false, errors.Wrapf(err, "unmarshaling mvcc meta: %v", kv)
-			}
+	err = s.snap.IterateFiltered(sp.Key, sp.EndKey, IterOptions{IntentsOnly: true},
+		func(kv engine.MVCCKeyValue) (bool, error) {
+			if !kv.Key.IsValue() {
+				// Found a metadata key. Inform the Processor if it's an intent.
+				if err := protoutil.Unmarshal(kv.Value, &meta); err != nil {
+					return false, errors.Wrapf(err, "unmarshaling mvcc meta: %v", kv)
+				}
 
-			if meta.Txn != nil {
-				var op enginepb.MVCCLogicalOp
-				op.SetValue(&enginepb.MVCCWriteIntentOp{
-					TxnID:     meta.Txn.ID,
-					TxnKey:    meta.Txn.Key,
-					Timestamp: meta.Txn.Timestamp,
-				})
-				s.p.ConsumeLogicalOps(op)
+				if meta.Txn != nil {
+					var op enginepb.MVCCLogicalOp
+					op.SetValue(&enginepb.MVCCWriteIntentOp{
+						TxnID:     meta.Txn.ID,
+						TxnKey:    meta.Txn.Key,
+						Timestamp: meta.Txn.Timestamp,
+					})
+					s.p.ConsumeLogicalOps(op)
+				}
 			}
-		}
-		return false, nil
-	})
+			return false, nil
+		})
 
 	if err != nil {
 		err = errors.Wrap(err, "initial resolved timestamp scan failed")
@@ -107,11 +199,108 @@ func (s *initResolvedTSScan) Cancel() {
 	s.snap.Close()
 }
 
+// defaultCatchUpScanBatchSize is the target size, in bytes, of a
+// RangeFeedBatch accumulated by a catchUpScan before it is flushed to the
+// registration's stream. A registration may override this via
+// maxCatchUpScanBatchBytes. Batching amortizes the per-call overhead of
+// stream.Send, which would otherwise be paid once per MVCC version visited
+// by the scan -- potentially millions of times on a historical range.
+const defaultCatchUpScanBatchSize = 64 << 10 // 64KB
+
+// catchUpScanBatch accumulates RangeFeedValues from a catchUpScan so that
+// they can be delivered to the registration's stream as a single
+// RangeFeedBatch instead of one RangeFeedEvent per key.
+type catchUpScanBatch struct {
+	values []roachpb.RangeFeedValue
+	bytes  int64
+}
+
+func (b *catchUpScanBatch) add(v roachpb.RangeFeedValue) {
+	b.values = append(b.values, v)
+	b.bytes += int64(len(v.Key)) + int64(len(v.Value.RawBytes))
+}
+
+func (b *catchUpScanBatch) empty() bool {
+	return len(b.values) == 0
+}
+
+func (b *catchUpScanBatch) reset() {
+	// Start a fresh slice rather than truncating: the old one is now owned
+	// by the RangeFeedBatch that was just sent.
+	b.values = nil
+	b.bytes = 0
+}
+
+// defaultCatchUpScanChunkBytes bounds how many bytes of value data a
+// catchUpScan will emit before pausing the scan, emitting a CatchUpProgress
+// checkpoint, and yielding back to the Processor. A registration may
+// override this via maxCatchUpScanChunkBytes. Without a bound, a scan over a
+// large historical range runs to completion inside a single goroutine that
+// holds a Snapshot open for the entire duration, pinning engine resources
+// and delaying steady-state streaming for the registration.
+const defaultCatchUpScanChunkBytes = 16 << 20 // 16MB
+
+// catchUpScanCursor identifies the last key/timestamp pair that a
+// catchUpScan emitted before it yielded. A subsequent scan over a fresh
+// Snapshot, constructed with this cursor, resumes just past it instead of
+// restarting the scan from the beginning of the registration's span.
+type catchUpScanCursor struct {
+	Key       roachpb.Key
+	Timestamp hlc.Timestamp
+}
+
+// isEmpty returns true for the zero-value cursor, which indicates that a
+// catchUpScan has no progress to resume from and should start at the
+// beginning of the registration's span.
+func (c catchUpScanCursor) isEmpty() bool {
+	return len(c.Key) == 0
+}
+
+// after returns whether the given key/timestamp pair was already emitted by
+// the chunk that produced this cursor and should be skipped on resume.
+func (c catchUpScanCursor) after(key roachpb.Key, ts hlc.Timestamp) bool {
+	if c.isEmpty() {
+		return false
+	}
+	if cmp := c.Key.Compare(key); cmp != 0 {
+		return cmp > 0
+	}
+	// Same key: MVCC versions are visited from newest to oldest, so "already
+	// emitted" means at or above the cursor's timestamp.
+	return !ts.Less(c.Timestamp)
+}
+
 // catchUpScan scans over the provided Snapshot and publishes committed values
 // to the registration's stream. This backfill allows a registration to request
 // a starting timestamp in the past and observe events for writes that have
 // already happened.
 //
+// Values are not sent to the stream one at a time. Instead, catchUpScan
+// accumulates them into a catchUpScanBatch and flushes it as a single
+// RangeFeedBatch event whenever the batch reaches maxCatchUpScanBatchBytes
+// (or maxCatchUpScanBatchRows), whenever the scan moves on to a new key, or
+// when the iterator finishes. This bounds the number of Send calls on a
+// historical range with many versions and gives a slow consumer a knob
+// (registration.maxCatchUpScanBatchRows) to apply backpressure by shrinking
+// the batch size.
+//
+// The scan is further divided into chunks bounded by
+// maxCatchUpScanChunkBytes. After each chunk it emits a CatchUpProgress
+// event carrying a catchUpScanCursor and yields by calling
+// Processor.resumeCatchUpScan instead of Processor.deliverCatchUpScanRes.
+// resumeCatchUpScan records that cursor on the registration, so that a
+// catchUpScan made from it afterwards by makeCatchUpScan, over a fresh
+// Snapshot, picks up past the last emitted key/timestamp rather than
+// restarting, and no single Snapshot (and the resources it holds) is
+// pinned open for the scan's full duration.
+//
+// An intent encountered by the scan is not ignored: it
+// is added to the Processor's unresolvedIntentQueue and forwarded as a
+// provisional RangeFeedSSTable event, and Processor.intentResolver is given
+// a bounded chance to push it. This avoids silently missing a value whose intent
+// commits after this scan finishes but before the live stream is spliced
+// in.
+//
 // Snapshot Contract:
 //   The Snapshot must expose all values in the registration's key range, not
 //   just the most recent value for a given key. It does not make any guarantees
@@ -123,13 +312,14 @@ func (s *initResolvedTSScan) Cancel() {
 //   starting timestamp.
 //
 type catchUpScan struct {
-	p    *Processor
-	r    *registration
-	snap Snapshot
+	p      *Processor
+	r      *registration
+	snap   Snapshot
+	cursor catchUpScanCursor
 }
 
 func makeCatchUpScan(p *Processor, r *registration) runnable {
-	s := catchUpScan{p: p, r: r, snap: r.catchUpSnap}
+	s := catchUpScan{p: p, r: r, snap: r.catchUpSnap, cursor: r.resumeCursor}
 	r.catchUpSnap = nil // detach
 	return &s
 }
@@ -137,16 +327,125 @@ func makeCatchUpScan(p *Processor, r *registration) runnable {
 func (s *catchUpScan) Run(ctx context.Context) {
 	defer s.snap.Close()
 
+	maxBatchBytes := s.r.maxCatchUpScanBatchBytes
+	if maxBatchBytes == 0 {
+		maxBatchBytes = defaultCatchUpScanBatchSize
+	}
+	maxChunkBytes := s.r.maxCatchUpScanChunkBytes
+	if maxChunkBytes == 0 {
+		maxChunkBytes = defaultCatchUpScanChunkBytes
+	}
+
+	// Reserve this chunk's worst-case footprint up front so that many
+	// registrations' catch-up scans can't pile up unbounded memory across
+	// the Processor (or Store) concurrently.
+	release, err := reserveCatchUpScanBudget(ctx, s.p, maxChunkBytes)
+	if err != nil {
+		err = errors.Wrap(err, "catch-up scan failed")
+		log.Error(ctx, err)
+		s.p.deliverCatchUpScanRes(s.r, roachpb.NewError(err))
+		return
+	}
+	defer release()
+
 	var meta enginepb.MVCCMetadata
+	var batch catchUpScanBatch
+	var lastKey roachpb.Key
+	var chunkBytes int64
+	var lastCursor catchUpScanCursor
+	yielded := false
+
+	flush := func() error {
+		if batch.empty() {
+			return nil
+		}
+		var event roachpb.RangeFeedEvent
+		event.SetValue(&roachpb.RangeFeedBatch{Values: batch.values})
+		err := s.r.stream.Send(&event)
+		batch.reset()
+		return err
+	}
+
+	sendProgress := func(cursor catchUpScanCursor) error {
+		var event roachpb.RangeFeedEvent
+		event.SetValue(&roachpb.CatchUpProgress{
+			Key:       cursor.Key,
+			Timestamp: cursor.Timestamp,
+		})
+		return s.r.stream.Send(&event)
+	}
+
 	sp := s.r.span
-	err := s.snap.Iterate(sp.Key, sp.EndKey, func(kv engine.MVCCKeyValue) (bool, error) {
+	// On a resumed scan, start the iterator at the cursor's key instead of
+	// the beginning of the span: re-reading everything before it on every
+	// chunk would make a scan with N chunks do O(N^2) work over the span,
+	// which defeats the point of chunking. We may still re-visit some
+	// versions of the cursor's own key (older versions that weren't part
+	// of the chunk that produced it); cursor.after filters those out
+	// below.
+	startKey := sp.Key
+	if !s.cursor.isEmpty() {
+		startKey = s.cursor.Key
+	}
+	opts := IterOptions{MinTimestamp: s.r.startTS}
+	err = s.snap.IterateFiltered(startKey, sp.EndKey, opts, func(kv engine.MVCCKeyValue) (bool, error) {
+		if s.cursor.after(kv.Key.Key, kv.Key.Timestamp) {
+			// Already emitted by a prior chunk. Skip.
+			return false, nil
+		}
+
 		if !kv.Key.IsValue() {
 			// Found a metadata key.
 			if err := protoutil.Unmarshal(kv.Value, &meta); err != nil {
 				return false, errors.Wrapf(err, "unmarshaling mvcc meta: %v", kv)
 			}
 			if !meta.IsInline() {
-				// Not an inline value. Ignore.
+				if meta.Txn == nil {
+					// Not an inline value and not an intent. Ignore.
+					return false, nil
+				}
+				// An intent may commit after this scan finishes but
+				// before the live stream is spliced in, which would
+				// otherwise cause the committed value to be silently
+				// missed. Record it in the Processor's
+				// unresolvedIntentQueue so the live stream can pick up
+				// its eventual resolution, and forward a
+				// provisional event so an opted-in client can see the
+				// write now and a commit/abort event later.
+				s.p.unresolvedIntentQueue.Add(enginepb.MVCCWriteIntentOp{
+					TxnID:     meta.Txn.ID,
+					TxnKey:    meta.Txn.Key,
+					Timestamp: meta.Txn.Timestamp,
+				})
+				if err := flush(); err != nil {
+					return false, err
+				}
+				var event roachpb.RangeFeedEvent
+				event.SetValue(&roachpb.RangeFeedSSTable{
+					Key:       kv.Key.Key,
+					Timestamp: meta.Txn.Timestamp,
+					TxnID:     meta.Txn.ID.GetBytes(),
+				})
+				if err := s.r.stream.Send(&event); err != nil {
+					return false, err
+				}
+				// A bounded push routinely finds the intent still pending --
+				// that's the expected outcome, not a scan failure. The live
+				// stream will observe its eventual resolution via the
+				// unresolvedIntentQueue entry recorded above, so only a
+				// genuine push failure (not "still pending") should abort
+				// the scan.
+				res, err := PushResultPending, error(nil)
+				if s.p.intentResolver != nil {
+					res, err = s.p.intentResolver.MaybePush(ctx, meta.Txn)
+				}
+				if err != nil {
+					return false, err
+				}
+				if res == PushResultPending {
+					log.VEventf(ctx, 2, "intent on %s still pending after bounded push; "+
+						"will resolve via live stream once it commits or aborts", kv.Key.Key)
+				}
 				return false, nil
 			}
 
@@ -154,26 +453,57 @@ func (s *catchUpScan) Run(ctx context.Context) {
 			// filter on the registration's starting timestamp. Instead, we
 			// return all inline writes.
 			kv.Value = meta.RawBytes
-		} else if kv.Key.Timestamp.Less(s.r.startTS) {
-			// Before the registration's starting timestamp. Ignore.
-			return false, nil
 		}
 
-		var event roachpb.RangeFeedEvent
-		event.SetValue(&roachpb.RangeFeedValue{
+		// Flush whenever we move on to a new key so that a batch never
+		// holds more than one key's versions, and whenever the batch has
+		// grown past its target size or row count (which can split a
+		// single key's versions across batches).
+		if !batch.empty() && (!kv.Key.Key.Equal(lastKey) || batch.bytes >= maxBatchBytes ||
+			(s.r.maxCatchUpScanBatchRows > 0 && int64(len(batch.values)) >= s.r.maxCatchUpScanBatchRows)) {
+			if err := flush(); err != nil {
+				return false, err
+			}
+		}
+		lastKey = kv.Key.Key
+
+		valBytes := int64(len(kv.Key.Key)) + int64(len(kv.Value))
+		batch.add(roachpb.RangeFeedValue{
 			Key: kv.Key.Key,
 			Value: roachpb.Value{
 				RawBytes:  kv.Value,
 				Timestamp: kv.Key.Timestamp,
 			},
 		})
-		return false, s.r.stream.Send(&event)
+		chunkBytes += valBytes
+		lastCursor = catchUpScanCursor{Key: kv.Key.Key, Timestamp: kv.Key.Timestamp}
+
+		if chunkBytes >= maxChunkBytes {
+			if err := flush(); err != nil {
+				return false, err
+			}
+			if err := sendProgress(lastCursor); err != nil {
+				return false, err
+			}
+			yielded = true
+			return true, nil
+		}
+		return false, nil
 	})
 
+	if err == nil && !yielded {
+		err = flush()
+	}
+
 	if err != nil {
 		err = errors.Wrap(err, "catch-up scan failed")
 		log.Error(ctx, err)
 		s.p.deliverCatchUpScanRes(s.r, roachpb.NewError(err))
+	} else if yielded {
+		// Hand lastCursor to the Processor so that a later scan over a
+		// fresh Snapshot resumes past it, rather than pinning this Snapshot
+		// open for the remainder of the scan.
+		s.p.resumeCatchUpScan(s.r, lastCursor)
 	} else {
 		s.p.deliverCatchUpScanRes(s.r, nil)
 	}
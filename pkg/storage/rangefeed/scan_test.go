@@ -0,0 +1,432 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rangefeed
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// fakeSnapshot is an in-memory Snapshot over a fixed, pre-sorted slice of
+// MVCCKeyValues, for use in tests that don't need a real storage engine.
+type fakeSnapshot struct {
+	kvs []engine.MVCCKeyValue
+}
+
+func (s *fakeSnapshot) Iterate(
+	start, end roachpb.Key, f func(engine.MVCCKeyValue) (bool, error),
+) error {
+	return s.IterateFiltered(start, end, IterOptions{}, f)
+}
+
+func (s *fakeSnapshot) IterateFiltered(
+	start, end roachpb.Key, opts IterOptions, f func(engine.MVCCKeyValue) (bool, error),
+) error {
+	for _, kv := range s.kvs {
+		if kv.Key.Key.Compare(start) < 0 {
+			continue
+		}
+		if len(end) > 0 && kv.Key.Key.Compare(end) >= 0 {
+			continue
+		}
+		if len(opts.KeyPrefix) > 0 && !bytes.HasPrefix(kv.Key.Key, opts.KeyPrefix) {
+			continue
+		}
+		if opts.IntentsOnly && kv.Key.IsValue() {
+			continue
+		}
+		if kv.Key.IsValue() {
+			if (opts.MinTimestamp != hlc.Timestamp{}) && kv.Key.Timestamp.Less(opts.MinTimestamp) {
+				continue
+			}
+			if (opts.MaxTimestamp != hlc.Timestamp{}) && opts.MaxTimestamp.Less(kv.Key.Timestamp) {
+				continue
+			}
+		}
+		done, err := f(kv)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *fakeSnapshot) Close() {}
+
+// fakeStream records every RangeFeedEvent sent to it.
+type fakeStream struct {
+	events []*roachpb.RangeFeedEvent
+}
+
+func (s *fakeStream) Send(e *roachpb.RangeFeedEvent) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+// valuesSent unpacks every RangeFeedValue sent to the stream so far,
+// whether delivered individually or inside a RangeFeedBatch.
+func (s *fakeStream) valuesSent() []roachpb.RangeFeedValue {
+	var got []roachpb.RangeFeedValue
+	for _, e := range s.events {
+		switch t := e.GetValue().(type) {
+		case *roachpb.RangeFeedValue:
+			got = append(got, *t)
+		case *roachpb.RangeFeedBatch:
+			got = append(got, t.Values...)
+		}
+	}
+	return got
+}
+
+// TestCatchUpScanBatchFlushBoundaries verifies that catchUpScan flushes its
+// in-progress RangeFeedBatch whenever the key changes, rather than letting a
+// batch span multiple keys or splitting a single key's versions across
+// batches.
+func TestCatchUpScanBatchFlushBoundaries(t *testing.T) {
+	ctx := context.Background()
+
+	kvs := []engine.MVCCKeyValue{
+		{Key: engine.MVCCKey{Key: roachpb.Key("a"), Timestamp: hlc.Timestamp{WallTime: 2}}, Value: []byte("a@2")},
+		{Key: engine.MVCCKey{Key: roachpb.Key("a"), Timestamp: hlc.Timestamp{WallTime: 1}}, Value: []byte("a@1")},
+		{Key: engine.MVCCKey{Key: roachpb.Key("b"), Timestamp: hlc.Timestamp{WallTime: 1}}, Value: []byte("b@1")},
+	}
+	snap := &fakeSnapshot{kvs: kvs}
+	stream := &fakeStream{}
+	p := &Processor{}
+	r := &registration{
+		span:   roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")},
+		stream: stream,
+		// Large enough that every version fits in a single batch were it
+		// not for the per-key flush boundary.
+		maxCatchUpScanBatchBytes: 1 << 20,
+		catchUpSnap:              snap,
+	}
+
+	s := makeCatchUpScan(p, r)
+	s.Run(ctx)
+
+	var batches []*roachpb.RangeFeedBatch
+	for _, e := range stream.events {
+		if b, ok := e.GetValue().(*roachpb.RangeFeedBatch); ok {
+			batches = append(batches, b)
+		}
+	}
+	if len(batches) != 2 {
+		t.Fatalf("expected one flush per key (2 batches), got %d", len(batches))
+	}
+	if len(batches[0].Values) != 2 || batches[0].Values[0].Key.Compare(roachpb.Key("a")) != 0 {
+		t.Errorf("expected first batch to hold both versions of key %q, got %+v", "a", batches[0].Values)
+	}
+	if len(batches[1].Values) != 1 || batches[1].Values[0].Key.Compare(roachpb.Key("b")) != 0 {
+		t.Errorf("expected second batch to hold key %q, got %+v", "b", batches[1].Values)
+	}
+}
+
+// equalStrs reports whether got, stringified, matches the elements of want.
+func equalStrs(got []engine.MVCCKeyValue, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i, kv := range got {
+		if string(kv.Key.Key) != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestIterateFilteredHonorsMaxTimestampAndKeyPrefix verifies that
+// fakeSnapshot.IterateFiltered actually applies MaxTimestamp and KeyPrefix,
+// not just MinTimestamp.
+func TestIterateFilteredHonorsMaxTimestampAndKeyPrefix(t *testing.T) {
+	kvs := []engine.MVCCKeyValue{
+		{Key: engine.MVCCKey{Key: roachpb.Key("a1"), Timestamp: hlc.Timestamp{WallTime: 1}}},
+		{Key: engine.MVCCKey{Key: roachpb.Key("a2"), Timestamp: hlc.Timestamp{WallTime: 5}}},
+		{Key: engine.MVCCKey{Key: roachpb.Key("b1"), Timestamp: hlc.Timestamp{WallTime: 1}}},
+	}
+	snap := &fakeSnapshot{kvs: kvs}
+
+	var got []engine.MVCCKeyValue
+	opts := IterOptions{MaxTimestamp: hlc.Timestamp{WallTime: 1}, KeyPrefix: roachpb.Key("a")}
+	if err := snap.IterateFiltered(nil, nil, opts, func(kv engine.MVCCKeyValue) (bool, error) {
+		got = append(got, kv)
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrs(got, "a1") {
+		t.Errorf("expected MaxTimestamp and KeyPrefix to restrict the scan to [a1], got %+v", got)
+	}
+}
+
+func TestCatchUpScanCursorAfter(t *testing.T) {
+	var empty catchUpScanCursor
+	if empty.after(roachpb.Key("a"), hlc.Timestamp{WallTime: 1}) {
+		t.Error("empty cursor should not skip anything")
+	}
+
+	c := catchUpScanCursor{Key: roachpb.Key("b"), Timestamp: hlc.Timestamp{WallTime: 5}}
+	if !c.after(roachpb.Key("a"), hlc.Timestamp{WallTime: 100}) {
+		t.Error("a key sorting before the cursor's key must be considered already emitted")
+	}
+	if c.after(roachpb.Key("c"), hlc.Timestamp{WallTime: 1}) {
+		t.Error("a key sorting after the cursor's key must not be considered already emitted")
+	}
+	if !c.after(roachpb.Key("b"), hlc.Timestamp{WallTime: 5}) {
+		t.Error("the cursor's own key/timestamp must be considered already emitted")
+	}
+	if !c.after(roachpb.Key("b"), hlc.Timestamp{WallTime: 10}) {
+		t.Error("a newer version of the cursor's key must be considered already emitted")
+	}
+	if c.after(roachpb.Key("b"), hlc.Timestamp{WallTime: 1}) {
+		t.Error("an older version of the cursor's key must not be considered already emitted")
+	}
+}
+
+// TestCatchUpScanResumeNoDuplicatesNoGaps drives a catchUpScan across many
+// small chunks -- each one yielding with a CatchUpProgress event and a
+// fresh cursor -- and verifies that the concatenation of every chunk's
+// RangeFeedValues is exactly the input set, each emitted exactly once, in
+// spite of the scan resuming its Snapshot.Iterate call from the cursor on
+// every chunk.
+func TestCatchUpScanResumeNoDuplicatesNoGaps(t *testing.T) {
+	ctx := context.Background()
+
+	var kvs []engine.MVCCKeyValue
+	want := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		key := roachpb.Key(fmt.Sprintf("key%02d", i))
+		for v := int64(3); v >= 1; v-- {
+			kvs = append(kvs, engine.MVCCKeyValue{
+				Key:   engine.MVCCKey{Key: key, Timestamp: hlc.Timestamp{WallTime: v}},
+				Value: []byte(fmt.Sprintf("%s-v%d", key, v)),
+			})
+			want[fmt.Sprintf("%s@%d", key, v)] = true
+		}
+	}
+
+	snap := &fakeSnapshot{kvs: kvs}
+	stream := &fakeStream{}
+	p := &Processor{}
+	r := &registration{
+		span:                     roachpb.Span{Key: roachpb.Key("key00"), EndKey: roachpb.Key("key99")},
+		stream:                   stream,
+		maxCatchUpScanChunkBytes: 24, // force several small chunks
+	}
+
+	for i := 0; i < len(kvs)+2; i++ {
+		before := len(stream.events)
+		r.catchUpSnap = snap
+		s := makeCatchUpScan(p, r)
+		s.Run(ctx)
+
+		newEvents := stream.events[before:]
+		if len(newEvents) == 0 {
+			t.Fatalf("iteration %d: Run produced no events", i)
+		}
+		if _, yielded := newEvents[len(newEvents)-1].GetValue().(*roachpb.CatchUpProgress); !yielded {
+			break // scan ran to completion
+		}
+		if i == len(kvs)+1 {
+			t.Fatalf("scan did not complete after %d resumes", i+1)
+		}
+	}
+
+	got := map[string]int{}
+	for _, v := range stream.valuesSent() {
+		got[fmt.Sprintf("%s@%d", v.Key, v.Value.Timestamp.WallTime)]++
+	}
+	for k := range want {
+		if got[k] != 1 {
+			t.Errorf("expected %q to be emitted exactly once across resumes, got %d", k, got[k])
+		}
+	}
+	for k := range got {
+		if !want[k] {
+			t.Errorf("emitted unexpected entry %q", k)
+		}
+	}
+}
+
+// fakeIntentResolver is a configurable IntentResolver for tests.
+type fakeIntentResolver struct {
+	calls []*enginepb.TxnMeta
+	res   PushResult
+	err   error
+}
+
+func (r *fakeIntentResolver) MaybePush(
+	ctx context.Context, txn *enginepb.TxnMeta,
+) (PushResult, error) {
+	r.calls = append(r.calls, txn)
+	return r.res, r.err
+}
+
+// marshalMVCCMetadata marshals meta as catchUpScan expects to unmarshal it
+// from a metadata key's value.
+func marshalMVCCMetadata(t *testing.T, meta enginepb.MVCCMetadata) []byte {
+	t.Helper()
+	b, err := protoutil.Marshal(&meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestCatchUpScanIntentHandling verifies that an intent encountered by
+// catchUpScan is recorded in the Processor's unresolvedIntentQueue and
+// forwarded as a provisional RangeFeedSSTable, and that only a genuine
+// push failure -- not a still-pending push -- aborts the scan.
+func TestCatchUpScanIntentHandling(t *testing.T) {
+	txn := &enginepb.TxnMeta{ID: uuid.MakeV4(), Timestamp: hlc.Timestamp{WallTime: 1}}
+	meta := enginepb.MVCCMetadata{Txn: txn}
+
+	newScan := func(resolver *fakeIntentResolver) (*fakeStream, *Processor) {
+		kvs := []engine.MVCCKeyValue{
+			{Key: engine.MVCCKey{Key: roachpb.Key("a")}, Value: marshalMVCCMetadata(t, meta)},
+			{Key: engine.MVCCKey{Key: roachpb.Key("b"), Timestamp: hlc.Timestamp{WallTime: 1}}, Value: []byte("b@1")},
+		}
+		stream := &fakeStream{}
+		p := &Processor{unresolvedIntentQueue: newUnresolvedIntentQueue(), intentResolver: resolver}
+		r := &registration{
+			span:   roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")},
+			stream: stream,
+		}
+		r.catchUpSnap = &fakeSnapshot{kvs: kvs}
+		makeCatchUpScan(p, r).Run(context.Background())
+		return stream, p
+	}
+
+	t.Run("pending push does not abort the scan", func(t *testing.T) {
+		resolver := &fakeIntentResolver{res: PushResultPending}
+		stream, p := newScan(resolver)
+		if len(resolver.calls) != 1 {
+			t.Fatalf("expected MaybePush to be called once, got %d", len(resolver.calls))
+		}
+		if len(p.unresolvedIntentQueue.ops) != 1 {
+			t.Errorf("expected the intent to be recorded in unresolvedIntentQueue, got %d entries",
+				len(p.unresolvedIntentQueue.ops))
+		}
+		var sawSSTable bool
+		for _, e := range stream.events {
+			if _, ok := e.GetValue().(*roachpb.RangeFeedSSTable); ok {
+				sawSSTable = true
+			}
+		}
+		if !sawSSTable {
+			t.Error("expected a provisional RangeFeedSSTable event")
+		}
+	})
+
+	t.Run("push error aborts the scan", func(t *testing.T) {
+		resolver := &fakeIntentResolver{err: errors.New("push failed")}
+		stream, _ := newScan(resolver)
+		for _, v := range stream.valuesSent() {
+			if v.Key.Equal(roachpb.Key("b")) {
+				t.Error("expected the scan to abort before reaching key \"b\", after the push failed on key \"a\"")
+			}
+		}
+	})
+}
+
+// fakeBudgetAccount is a budgetAccount backed by a fixed limit, for tests
+// that exercise reserveCatchUpScanBudget without a real mon.BytesMonitor.
+type fakeBudgetAccount struct {
+	limit int64
+	used  int64
+}
+
+func (a *fakeBudgetAccount) Grow(ctx context.Context, x int64) error {
+	if a.used+x > a.limit {
+		return errors.Errorf("budget exhausted: used %d, limit %d, requested %d", a.used, a.limit, x)
+	}
+	a.used += x
+	return nil
+}
+
+func (a *fakeBudgetAccount) Shrink(ctx context.Context, x int64) {
+	a.used -= x
+}
+
+// TestReserveCatchUpScanBudget covers reserveCatchUpScanBudget's three
+// paths: a nil budget is a no-op, a successful reservation/release
+// round-trip updates the reserved-bytes gauge, and an exhausted budget
+// rejects the scan with a RangeFeedRetryError_REASON_SLOW_CONSUMER and
+// bumps the rejected-scans counter.
+func TestReserveCatchUpScanBudget(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("nil budget is a no-op", func(t *testing.T) {
+		p := &Processor{}
+		release, err := reserveCatchUpScanBudget(ctx, p, 1<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	})
+
+	t.Run("reservation and release round-trip", func(t *testing.T) {
+		account := &fakeBudgetAccount{limit: 1 << 20}
+		metrics := NewMetrics()
+		p := &Processor{catchUpScanBudget: account, Metrics: metrics}
+
+		release, err := reserveCatchUpScanBudget(ctx, p, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := metrics.RangeFeedCatchUpScanReservedBytes.Value(); got != 100 {
+			t.Errorf("expected 100 reserved bytes, got %d", got)
+		}
+		release()
+		if got := metrics.RangeFeedCatchUpScanReservedBytes.Value(); got != 0 {
+			t.Errorf("expected the reservation to be released, got %d bytes still reserved", got)
+		}
+	})
+
+	t.Run("exhausted budget is rejected", func(t *testing.T) {
+		account := &fakeBudgetAccount{limit: 100}
+		metrics := NewMetrics()
+		p := &Processor{catchUpScanBudget: account, Metrics: metrics}
+
+		_, err := reserveCatchUpScanBudget(ctx, p, 1000)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		retryErr, ok := err.(*roachpb.RangeFeedRetryError)
+		if !ok {
+			t.Fatalf("expected *roachpb.RangeFeedRetryError, got %T", err)
+		}
+		if retryErr.Reason != roachpb.RangeFeedRetryError_REASON_SLOW_CONSUMER {
+			t.Errorf("expected REASON_SLOW_CONSUMER, got %v", retryErr.Reason)
+		}
+		if got := metrics.RangeFeedCatchUpScanNumRejected.Count(); got != 1 {
+			t.Errorf("expected 1 rejected scan, got %d", got)
+		}
+	})
+}